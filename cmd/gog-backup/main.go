@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -15,8 +16,13 @@ import (
 	"github.com/bclicn/color"
 	"github.com/juju/ratelimit"
 	"github.com/mscharley/gog-backup/internal/gog-backup/backend"
-	"github.com/mscharley/gog-backup/internal/gog-backup/backend/local"
-	"github.com/mscharley/gog-backup/internal/gog-backup/backend/s3"
+	_ "github.com/mscharley/gog-backup/internal/gog-backup/backend/azure"
+	_ "github.com/mscharley/gog-backup/internal/gog-backup/backend/gcs"
+	_ "github.com/mscharley/gog-backup/internal/gog-backup/backend/local"
+	_ "github.com/mscharley/gog-backup/internal/gog-backup/backend/oss"
+	_ "github.com/mscharley/gog-backup/internal/gog-backup/backend/s3"
+	"github.com/mscharley/gog-backup/internal/gog-backup/progress"
+	"github.com/mscharley/gog-backup/internal/gog-backup/selfupdate"
 	"github.com/mscharley/gog-backup/pkg/gog"
 	"github.com/vharitonsky/iniflags"
 )
@@ -25,6 +31,11 @@ var (
 	waitGroup = new(sync.WaitGroup)
 )
 
+// version is gog-backup's release tag, set via -ldflags "-X main.version=..." at build time. The
+// default "dev" never matches a GitHub release tag, so a dev build always reports an update being
+// available rather than silently appearing up to date.
+var version = "dev"
+
 var (
 	backendOpt     = flag.String("backend", "local", "Which backend to use for processing files to backup. The default, local, uses a folder on your hard drive.")
 	refreshToken   = flag.String("refresh-token", "", "A refresh token for the GoG API.")
@@ -35,6 +46,11 @@ var (
 	extraDownloads = flag.Int("extra-downloads", 2, "How many extras to download concurrently.")
 	limitDownload  = flag.Int("limit-download", 0, "Download limit in KiB/s. (default: unlimited)")
 	limitUpload    = flag.Int("limit-upload", 0, "Upload limit in KiB/s (default: unlimited)")
+
+	noProgress = flag.Bool("no-progress", false, "Disable the per-worker and aggregate progress bars.")
+	silent     = flag.Bool("silent", false, "Suppress all log output. Progress bars, if enabled, are unaffected.")
+
+	dedupStore = flag.Bool("dedup-store", false, "Store downloads content-addressed under objects/<sha256>, deduplicating identical files shared between games, DLCs and platforms.")
 )
 
 func main() {
@@ -44,6 +60,10 @@ func main() {
 		log.Fatalln("You must provide a refresh token for GoG.com via -refresh-token.")
 	}
 
+	if *silent {
+		log.SetOutput(ioutil.Discard)
+	}
+
 	client := &gog.Client{
 		Client:       http.DefaultClient,
 		RefreshToken: *refreshToken,
@@ -61,15 +81,23 @@ func main() {
 		uploadBucket = ratelimit.NewBucketWithRate(float64(*limitUpload*1024), int64(*limitDownload*1024))
 	}
 
-	switch *backendOpt {
-	case "local":
-		backendHandler = local.DownloadFile(retries, downloadBucket)
-	case "s3":
-		backendHandler, err = s3.DownloadFile(retries, uploadBucket, downloadBucket)
-	default:
-		log.Fatalf("Unknown backend (%s): valid values are; local, s3", *backendOpt)
+	progressPool, err := progress.New(*gameDownloads+*extraDownloads, !*noProgress)
+	if err != nil {
+		log.Fatalf("Error starting progress bars: %+v", err)
+	}
+
+	backend.Shared.Retries = retries
+	backend.Shared.DownloadBucket = downloadBucket
+	backend.Shared.UploadBucket = uploadBucket
+	backend.Shared.Progress = progressPool
+	backend.Shared.DedupStore = dedupStore
+
+	factory, ok := backend.Lookup(*backendOpt)
+	if !ok {
+		log.Fatalf("Unknown backend (%s): valid values are; %s", *backendOpt, strings.Join(backend.Names(), ", "))
 	}
 
+	backendHandler, err = factory()
 	if err != nil {
 		log.Fatalf("Error loading the backend (%s): %+v", *backendOpt, err)
 	}
@@ -79,18 +107,20 @@ func main() {
 	gameDownload := make(chan *backend.GogFile)
 	extraDownload := make(chan *backend.GogFile, 10)
 
-	go signalHandler(finished)
+	go signalHandler(finished, progressPool)
 	go generateGames(gameInfo, finished, client)
 	go fetchDetails(gameInfo, gameDownload, extraDownload, client)
+	go selfupdate.Run(finished, version)
 
 	waitGroup.Add(*gameDownloads + *extraDownloads)
 	for i := 0; i < *gameDownloads; i++ {
-		go backendHandler(gameDownload, waitGroup, client)
+		go backendHandler.Process(gameDownload, waitGroup, client)
 	}
 	for i := 0; i < *extraDownloads; i++ {
-		go backendHandler(extraDownload, waitGroup, client)
+		go backendHandler.Process(extraDownload, waitGroup, client)
 	}
 	waitGroup.Wait()
+	progressPool.Finish()
 }
 
 func generateGames(games chan<- int64, finished <-chan bool, client *gog.Client) {
@@ -153,6 +183,7 @@ func fetchDetails(games <-chan int64, gameDownload chan<- *backend.GogFile, extr
 						URL:     gog.EmbedEndpoint + extra.ManualDownloadURL,
 						File:    path + "/Extras",
 						Version: extra.Version,
+						Size:    progress.ParseSize(extra.Size),
 					}
 				}
 
@@ -164,6 +195,7 @@ func fetchDetails(games <-chan int64, gameDownload chan<- *backend.GogFile, extr
 							URL:     gog.EmbedEndpoint + d.ManualDownloadURL,
 							File:    path + "/Windows",
 							Version: d.Version,
+							Size:    progress.ParseSize(d.Size),
 						}
 					}
 					for _, d := range download.Platforms.Mac {
@@ -172,6 +204,7 @@ func fetchDetails(games <-chan int64, gameDownload chan<- *backend.GogFile, extr
 							URL:     gog.EmbedEndpoint + d.ManualDownloadURL,
 							File:    path + "/Mac",
 							Version: d.Version,
+							Size:    progress.ParseSize(d.Size),
 						}
 					}
 					for _, d := range download.Platforms.Linux {
@@ -180,6 +213,7 @@ func fetchDetails(games <-chan int64, gameDownload chan<- *backend.GogFile, extr
 							URL:     gog.EmbedEndpoint + d.ManualDownloadURL,
 							File:    path + "/Linux",
 							Version: d.Version,
+							Size:    progress.ParseSize(d.Size),
 						}
 					}
 				}
@@ -198,11 +232,14 @@ func fetchDetails(games <-chan int64, gameDownload chan<- *backend.GogFile, extr
 	close(extraDownload)
 }
 
-func signalHandler(finished chan<- bool) {
+func signalHandler(finished chan<- bool, progressPool *progress.Pool) {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 
 	signal := <-c
+	// Stop the bars before anything else logs, or the terminal is left with bars half-drawn over
+	// whatever we print next.
+	progressPool.Finish()
 	finished <- true
 	close(finished)
 	log.Printf("Received a %s signal, finishing downloads before closing.", signal)
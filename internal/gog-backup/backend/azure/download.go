@@ -0,0 +1,287 @@
+package azure
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/bclicn/color"
+	"github.com/mscharley/gog-backup/internal/gog-backup/backend"
+	"github.com/mscharley/gog-backup/internal/gog-backup/progress"
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+// copyPollInterval and copyPollTimeout bound how long copyBlob waits for an async server-side copy
+// to finish before giving up; GoG installers are many GB, so a successful copy can take a while.
+const (
+	copyPollInterval = 2 * time.Second
+	copyPollTimeout  = 30 * time.Minute
+)
+
+var (
+	account   = flag.String("azure-account", "", "The storage account to upload to. (backend=azure)")
+	container = flag.String("azure-container", "", "The container to upload to. (backend=azure)")
+	accessKey = flag.String("azure-access-key", "", "The access key for the storage account. (backend=azure)")
+	prefix    = flag.String("azure-prefix", "", "A prefix path to upload into a directory. (backend=azure)")
+)
+
+func init() {
+	backend.Register("azure", func() (backend.Handler, error) {
+		return DownloadFile(backend.Shared.Retries, backend.Shared.Progress, backend.Shared.DedupStore)
+	})
+}
+
+// handler is the azure backend's Handler. This backend downloads all the files from GoG and stores
+// them as blobs in an Azure Blob Storage container.
+type handler struct {
+	retries      *int
+	progressPool *progress.Pool
+	dedupStore   *bool
+	containerURL azblob.ContainerURL
+	ctx          context.Context
+}
+
+// DownloadFile is the entrypoint for the azure backend.
+func DownloadFile(retries *int, progressPool *progress.Pool, dedupStore *bool) (backend.Handler, error) {
+	credential, err := azblob.NewSharedKeyCredential(*account, *accessKey)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	serviceURL, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", *account))
+	if err != nil {
+		return nil, err
+	}
+	containerURL := azblob.NewServiceURL(*serviceURL, pipeline).NewContainerURL(*container)
+
+	return &handler{
+		retries:      retries,
+		progressPool: progressPool,
+		dedupStore:   dedupStore,
+		containerURL: containerURL,
+		ctx:          context.Background(),
+	}, nil
+}
+
+func (h *handler) readBlob(name string) (string, error) {
+	resp, err := h.containerURL.NewBlockBlobURL(name).Download(h.ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body(azblob.RetryReaderOptions{}))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (h *handler) blobExists(name string) bool {
+	_, err := h.containerURL.NewBlockBlobURL(name).GetProperties(h.ctx, azblob.BlobAccessConditions{})
+	return err == nil
+}
+
+func (h *handler) writeBlob(name string, content string) error {
+	_, err := h.containerURL.NewBlockBlobURL(name).Upload(h.ctx, strings.NewReader(content), azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{})
+	return err
+}
+
+func (h *handler) uploadBlob(reader io.Reader, name string) error {
+	_, err := azblob.UploadStreamToBlockBlob(h.ctx, reader, h.containerURL.NewBlockBlobURL(name), azblob.UploadStreamToBlockBlobOptions{})
+	return err
+}
+
+// copyBlob starts a server-side copy of src onto dst and blocks until Azure reports it has
+// finished, so callers can safely delete src as soon as copyBlob returns a nil error. A
+// StartCopyFromURL call only accepts the request; it does not wait for the copy itself.
+func (h *handler) copyBlob(src string, dst string) error {
+	dstURL := h.containerURL.NewBlockBlobURL(dst)
+	if _, err := dstURL.StartCopyFromURL(h.ctx, h.containerURL.NewBlockBlobURL(src).URL(), azblob.Metadata{}, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{}); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(copyPollTimeout)
+	for {
+		props, err := dstURL.GetProperties(h.ctx, azblob.BlobAccessConditions{})
+		if err != nil {
+			return err
+		}
+
+		switch props.CopyStatus() {
+		case azblob.CopyStatusSuccess:
+			return nil
+		case azblob.CopyStatusFailed, azblob.CopyStatusAborted:
+			return fmt.Errorf("copy of %s to %s failed: %s", src, dst, props.CopyStatusDescription())
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for copy of %s to %s to complete", src, dst)
+		}
+		time.Sleep(copyPollInterval)
+	}
+}
+
+func (h *handler) deleteBlob(name string) {
+	h.containerURL.NewBlockBlobURL(name).Delete(h.ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+}
+
+// Stat reports whether the blob for sha256 already exists in the container's objects/ store.
+func (h *handler) Stat(sha256 string) (bool, error) {
+	return h.blobExists(path.Join(*prefix, "objects", sha256)), nil
+}
+
+func (h *handler) Process(downloads <-chan *backend.GogFile, waitGroup *sync.WaitGroup, client *gog.Client) {
+	bar := h.progressPool.Worker()
+
+	for d := range downloads {
+		basepath := d.File
+		if *prefix != "" {
+			basepath = path.Join(*prefix, basepath)
+		}
+
+		for i := 1; i <= *h.retries; i++ {
+			var err error
+			if h.dedupStore != nil && *h.dedupStore {
+				err = h.processDedup(client, d, basepath, bar)
+			} else {
+				err = h.processPlain(client, d, basepath, bar)
+			}
+			if err != nil {
+				log.Printf("Unable to download file: %+v", err)
+				continue
+			}
+
+			// We successfully managed to download this file, skip the rest of our retries.
+			break
+		}
+	}
+
+	waitGroup.Done()
+}
+
+// alreadyUpToDate checks the ".version" sidecar blob that processPlain and processDedup leave next
+// to every versioned upload, so a file this container already has isn't downloaded and uploaded
+// again. The GoG download request has already been opened by the time this runs.
+func (h *handler) alreadyUpToDate(basepath string, filename string, d *backend.GogFile) bool {
+	if d.Version != "" {
+		versionBlob := path.Join(basepath, "."+filename+".version")
+		if lastVersion, _ := h.readBlob(versionBlob); lastVersion == d.Version {
+			log.Printf("Skipping %s as it is already up to date.\n", d.Name)
+			return true
+		}
+		return false
+	}
+	if h.blobExists(path.Join(basepath, filename)) {
+		log.Printf("Skipping %s as it is already backed up and isn't versioned.\n", d.Name)
+		return true
+	}
+	return false
+}
+
+func (h *handler) processPlain(client *gog.Client, d *backend.GogFile, basepath string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
+	}
+	readerTmp = bar.Wrap(d.Size, readerTmp)
+
+	if h.alreadyUpToDate(basepath, filename, d) {
+		readerTmp.Close()
+		return nil
+	}
+	versionBlob := path.Join(basepath, "."+filename+".version")
+
+	version := ""
+	if d.Version != "" {
+		version = " (version: " + color.Purple(d.Version) + ")"
+	}
+	key := path.Join(basepath, filename)
+	tmpKey := path.Join(basepath, "."+filename+".tmp")
+	fmt.Printf("%s%s\n  %s -> %s\n", d.Name, version, color.LightBlue(d.URL), color.Green("azure://"+*container+"/"+key))
+	err = h.uploadBlob(readerTmp, tmpKey)
+	readerTmp.Close()
+	if err != nil {
+		return fmt.Errorf("unable to upload file: %+v", err)
+	}
+
+	if err := h.copyBlob(tmpKey, key); err != nil {
+		return fmt.Errorf("unable to finalize uploaded file: %+v", err)
+	}
+	h.deleteBlob(tmpKey)
+
+	if d.Version != "" {
+		if err := h.writeBlob(versionBlob, d.Version); err != nil {
+			log.Printf("Unable to save version blob: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// processDedup streams d into a tmp blob while hashing it with SHA-256, then copies the tmp blob to
+// objects/<sha256> unless that object already exists, and leaves a manifest blob at the logical key
+// pointing at it. GoG's own checksum is not fetched or checked here, and the SHA-256 is only used to
+// name the blob.
+func (h *handler) processDedup(client *gog.Client, d *backend.GogFile, basepath string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
+	}
+
+	if h.alreadyUpToDate(basepath, filename, d) {
+		readerTmp.Close()
+		return nil
+	}
+	readerTmp = bar.Wrap(d.Size, readerTmp)
+	defer readerTmp.Close()
+
+	hasher := sha256.New()
+	tee := io.TeeReader(readerTmp, hasher)
+
+	key := path.Join(basepath, filename)
+	fmt.Printf("%s\n  %s -> %s (deduping)\n", d.Name, color.LightBlue(d.URL), color.Green("azure://"+*container+"/"+key))
+
+	tmpKey := path.Join(*prefix, ".dedup-incoming", basepath, filename)
+	if err := h.uploadBlob(tee, tmpKey); err != nil {
+		return fmt.Errorf("unable to upload file: %+v", err)
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	exists, err := h.Stat(sum)
+	if err != nil {
+		return err
+	}
+	if exists {
+		h.deleteBlob(tmpKey)
+	} else {
+		objectKey := path.Join(*prefix, "objects", sum)
+		if err := h.copyBlob(tmpKey, objectKey); err != nil {
+			return fmt.Errorf("unable to finalize uploaded file: %+v", err)
+		}
+		h.deleteBlob(tmpKey)
+	}
+
+	if err := h.writeBlob(key, "objects/"+sum+"\n"); err != nil {
+		return err
+	}
+
+	if d.Version != "" {
+		versionBlob := path.Join(basepath, "."+filename+".version")
+		if err := h.writeBlob(versionBlob, d.Version); err != nil {
+			log.Printf("Unable to save version blob: %+v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package backend
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/juju/ratelimit"
+	"github.com/mscharley/gog-backup/internal/gog-backup/progress"
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+// GogFile describes a single download task handed from the metadata-fetching pipeline to a
+// backend.
+type GogFile struct {
+	Name    string
+	URL     string
+	File    string
+	Version string
+	// Size is the download's size in bytes, parsed from GoG's human-readable size field. It seeds
+	// the aggregate progress bar's total and is 0 if GoG's size couldn't be parsed.
+	Size int64
+}
+
+// Handler is the entrypoint every backend exposes. Process drains a channel of downloads using the
+// given client, calling waitGroup.Done() once the channel is closed and every download (and its
+// retries) has been processed. Stat reports whether a content-addressed blob already exists under
+// the backend's objects/<sha256> store, so -dedup-store doesn't store a second copy of content it
+// already has. Backends call it only once the whole file has been downloaded (and, for remote
+// backends, uploaded to a staging key) and hashed, so a duplicate is still transferred in full.
+type Handler interface {
+	Process(downloads <-chan *GogFile, waitGroup *sync.WaitGroup, client *gog.Client)
+	Stat(sha256 string) (bool, error)
+}
+
+// Factory builds a Handler for a backend, returning an error if the backend can't be reached with
+// its current flags (e.g. an S3 bucket that doesn't exist).
+type Factory func() (Handler, error)
+
+// Shared holds the runtime settings common to every backend. main populates it from its top-level
+// flags before calling a backend's Factory via Lookup, so a backend doesn't need its own copies of
+// -retries, -limit-download and -limit-upload.
+var Shared = struct {
+	Retries        *int
+	DownloadBucket *ratelimit.Bucket
+	UploadBucket   *ratelimit.Bucket
+	Progress       *progress.Pool
+	DedupStore     *bool
+}{}
+
+var registry = map[string]Factory{}
+
+// Register makes a backend available under name for -backend to select. It is intended to be
+// called from a backend package's init() function.
+func Register(name string, factory Factory) {
+	registry[name] = factory
+}
+
+// Lookup returns the factory registered under name, and false if no backend registered that name.
+func Lookup(name string) (Factory, bool) {
+	factory, ok := registry[name]
+	return factory, ok
+}
+
+// Names returns the names of all registered backends, sorted for use in usage/error messages.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,248 @@
+package gcs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/bclicn/color"
+	"github.com/mscharley/gog-backup/internal/gog-backup/backend"
+	"github.com/mscharley/gog-backup/internal/gog-backup/progress"
+	"github.com/mscharley/gog-backup/pkg/gog"
+	"google.golang.org/api/option"
+)
+
+var (
+	bucketName = flag.String("gcs-bucket", "", "The bucket to upload to. (backend=gcs)")
+	prefix     = flag.String("gcs-prefix", "", "A prefix path to upload into a directory. (backend=gcs)")
+	credsFile  = flag.String("gcs-credentials", "", "Path to a service account JSON key file. (backend=gcs)")
+)
+
+func init() {
+	backend.Register("gcs", func() (backend.Handler, error) {
+		return DownloadFile(backend.Shared.Retries, backend.Shared.Progress, backend.Shared.DedupStore)
+	})
+}
+
+// handler is the gcs backend's Handler. This backend downloads all the files from GoG and stores
+// them as objects in a Google Cloud Storage bucket.
+type handler struct {
+	retries      *int
+	progressPool *progress.Pool
+	dedupStore   *bool
+	bkt          *storage.BucketHandle
+	ctx          context.Context
+}
+
+// DownloadFile is the entrypoint for the gcs backend.
+func DownloadFile(retries *int, progressPool *progress.Pool, dedupStore *bool) (backend.Handler, error) {
+	ctx := context.Background()
+
+	var opts []option.ClientOption
+	if *credsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(*credsFile))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	bkt := client.Bucket(*bucketName)
+
+	return &handler{retries: retries, progressPool: progressPool, dedupStore: dedupStore, bkt: bkt, ctx: ctx}, nil
+}
+
+func (h *handler) readObject(name string) (string, error) {
+	reader, err := h.bkt.Object(name).NewReader(h.ctx)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (h *handler) objectExists(name string) bool {
+	_, err := h.bkt.Object(name).Attrs(h.ctx)
+	return err == nil
+}
+
+func (h *handler) writeObject(name string, content string) error {
+	writer := h.bkt.Object(name).NewWriter(h.ctx)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// Stat reports whether the blob for sha256 already exists in the bucket's objects/ store.
+func (h *handler) Stat(sha256 string) (bool, error) {
+	return h.objectExists(path.Join(*prefix, "objects", sha256)), nil
+}
+
+func (h *handler) Process(downloads <-chan *backend.GogFile, waitGroup *sync.WaitGroup, client *gog.Client) {
+	bar := h.progressPool.Worker()
+
+	for d := range downloads {
+		basepath := d.File
+		if *prefix != "" {
+			basepath = path.Join(*prefix, basepath)
+		}
+
+		for i := 1; i <= *h.retries; i++ {
+			var err error
+			if h.dedupStore != nil && *h.dedupStore {
+				err = h.processDedup(client, d, basepath, bar)
+			} else {
+				err = h.processPlain(client, d, basepath, bar)
+			}
+			if err != nil {
+				log.Printf("Unable to download file: %+v", err)
+				continue
+			}
+
+			// We successfully managed to download this file, skip the rest of our retries.
+			break
+		}
+	}
+
+	waitGroup.Done()
+}
+
+// alreadyUpToDate compares d's version against the ".version" object processPlain and processDedup
+// write alongside every versioned upload, to skip re-downloading and re-uploading unchanged files.
+func (h *handler) alreadyUpToDate(basepath string, filename string, d *backend.GogFile) bool {
+	if d.Version != "" {
+		versionObject := path.Join(basepath, "."+filename+".version")
+		if lastVersion, _ := h.readObject(versionObject); lastVersion == d.Version {
+			log.Printf("Skipping %s as it is already up to date.\n", d.Name)
+			return true
+		}
+		return false
+	}
+	if h.objectExists(path.Join(basepath, filename)) {
+		log.Printf("Skipping %s as it is already backed up and isn't versioned.\n", d.Name)
+		return true
+	}
+	return false
+}
+
+func (h *handler) processPlain(client *gog.Client, d *backend.GogFile, basepath string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
+	}
+	readerTmp = bar.Wrap(d.Size, readerTmp)
+
+	if h.alreadyUpToDate(basepath, filename, d) {
+		readerTmp.Close()
+		return nil
+	}
+	versionObject := path.Join(basepath, "."+filename+".version")
+
+	version := ""
+	if d.Version != "" {
+		version = " (version: " + color.Purple(d.Version) + ")"
+	}
+	key := path.Join(basepath, filename)
+	tmpKey := path.Join(basepath, "."+filename+".tmp")
+	fmt.Printf("%s%s\n  %s -> %s\n", d.Name, version, color.LightBlue(d.URL), color.Green("gs://"+*bucketName+"/"+key))
+
+	writer := h.bkt.Object(tmpKey).NewWriter(h.ctx)
+	_, err = io.Copy(writer, readerTmp)
+	readerTmp.Close()
+	if err != nil {
+		writer.Close()
+		return fmt.Errorf("unable to upload file: %+v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("unable to finalize uploaded file: %+v", err)
+	}
+
+	if _, err := h.bkt.Object(key).CopierFrom(h.bkt.Object(tmpKey)).Run(h.ctx); err != nil {
+		return fmt.Errorf("unable to rename uploaded file: %+v", err)
+	}
+	h.bkt.Object(tmpKey).Delete(h.ctx)
+
+	if d.Version != "" {
+		if err := h.writeObject(versionObject, d.Version); err != nil {
+			log.Printf("Unable to save version object: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// processDedup uploads d to a tmp object, hashing it with SHA-256 as it goes, then server-side
+// copies it to objects/<sha256> (skipping the copy if that object is already present) and writes a
+// small manifest object at the logical key pointing at it. No checksum verification is done
+// against GoG in this mode, and the SHA-256 is only used to name the object.
+func (h *handler) processDedup(client *gog.Client, d *backend.GogFile, basepath string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
+	}
+
+	if h.alreadyUpToDate(basepath, filename, d) {
+		readerTmp.Close()
+		return nil
+	}
+	readerTmp = bar.Wrap(d.Size, readerTmp)
+	defer readerTmp.Close()
+
+	hasher := sha256.New()
+	tee := io.TeeReader(readerTmp, hasher)
+
+	key := path.Join(basepath, filename)
+	fmt.Printf("%s\n  %s -> %s (deduping)\n", d.Name, color.LightBlue(d.URL), color.Green("gs://"+*bucketName+"/"+key))
+
+	tmpKey := path.Join(*prefix, ".dedup-incoming", basepath, filename)
+	writer := h.bkt.Object(tmpKey).NewWriter(h.ctx)
+	if _, err := io.Copy(writer, tee); err != nil {
+		writer.Close()
+		return fmt.Errorf("unable to upload file: %+v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("unable to finalize uploaded file: %+v", err)
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	exists, err := h.Stat(sum)
+	if err != nil {
+		return err
+	}
+	if exists {
+		h.bkt.Object(tmpKey).Delete(h.ctx)
+	} else {
+		objectKey := path.Join(*prefix, "objects", sum)
+		if _, err := h.bkt.Object(objectKey).CopierFrom(h.bkt.Object(tmpKey)).Run(h.ctx); err != nil {
+			return fmt.Errorf("unable to finalize uploaded file: %+v", err)
+		}
+		h.bkt.Object(tmpKey).Delete(h.ctx)
+	}
+
+	if err := h.writeObject(key, "objects/"+sum+"\n"); err != nil {
+		return err
+	}
+
+	if d.Version != "" {
+		versionObject := path.Join(basepath, "."+filename+".version")
+		if err := h.writeObject(versionObject, d.Version); err != nil {
+			log.Printf("Unable to save version object: %+v", err)
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package local
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -12,6 +14,7 @@ import (
 	"github.com/bclicn/color"
 	"github.com/juju/ratelimit"
 	"github.com/mscharley/gog-backup/internal/gog-backup/backend"
+	"github.com/mscharley/gog-backup/internal/gog-backup/progress"
 	"github.com/mscharley/gog-backup/pkg/gog"
 )
 
@@ -19,73 +22,255 @@ var (
 	targetDir = flag.String("local-dir", os.Getenv("HOME")+"/GoG", "The target directory to download to. (backend=local)")
 )
 
-// DownloadFile is the entrypoint for the local backend. This backend downloads all the files from GoG and stores
+func init() {
+	backend.Register("local", func() (backend.Handler, error) {
+		return DownloadFile(backend.Shared.Retries, backend.Shared.DownloadBucket, backend.Shared.Progress, backend.Shared.DedupStore), nil
+	})
+}
+
+// handler is the local backend's Handler. This backend downloads all the files from GoG and stores
 // them in a folder structure on the local hard drive.
-func DownloadFile(retries *int, downloadBucket *ratelimit.Bucket) backend.Handler {
-	return func(downloads <-chan *backend.GogFile, waitGroup *sync.WaitGroup, client *gog.Client) {
-		for d := range downloads {
-			path := *targetDir + "/" + d.File
-
-			for i := 1; i <= *retries; i++ {
-				filename, readerTmp, err := client.DownloadFile(d.URL)
-				var reader io.Reader
-				if downloadBucket == nil {
-					reader = ratelimit.Reader(readerTmp, downloadBucket)
-				} else {
-					reader = readerTmp
-				}
-
-				if err != nil {
-					log.Printf("Unable to connect to GoG: %+v", err)
-					continue
-				}
-
-				// Check for version information from last time.
-				versionFile := path + "/." + filename + ".version"
-				if d.Version != "" {
-					if lastVersion, _ := ioutil.ReadFile(versionFile); string(lastVersion) == d.Version {
-						log.Printf("Skipping %s as it is already up to date.\n", d.Name)
-						readerTmp.Close()
-						break
-					}
-				} else if info, _ := os.Stat(path + "/" + filename); info != nil {
-					log.Printf("Skipping %s as it is backed up and isn't versioned.\n", d.Name)
-					readerTmp.Close()
-					break
-				}
-
-				version := ""
-				if d.Version != "" {
-					version = " (version: " + color.Purple(d.Version) + ")"
-				}
-				fmt.Printf("%s%s\n  %s -> %s\n", d.Name, version, color.LightBlue(d.URL), color.Green(path+"/"+filename))
-				err = downloadFile(reader, path, filename)
-				readerTmp.Close()
-				if err != nil {
-					log.Printf("Unable to download file: %+v", err)
-					continue
-				}
-
-				if d.Version != "" {
-					// Save version information for next time.
-					err = ioutil.WriteFile(versionFile, []byte(d.Version), 0666)
-					if err != nil {
-						log.Printf("Unable to save version file: %+v", err)
-						// Good enough for this run through - we'll redownload next time and retry saving the version file then.
-						break
-					}
-				}
-
-				// We successfully managed to download this file, skip the rest of our retries.
-				break
+type handler struct {
+	retries        *int
+	downloadBucket *ratelimit.Bucket
+	progressPool   *progress.Pool
+	dedupStore     *bool
+}
+
+// DownloadFile is the entrypoint for the local backend.
+func DownloadFile(retries *int, downloadBucket *ratelimit.Bucket, progressPool *progress.Pool, dedupStore *bool) backend.Handler {
+	return &handler{retries: retries, downloadBucket: downloadBucket, progressPool: progressPool, dedupStore: dedupStore}
+}
+
+// Stat reports whether the blob for sha256 already exists in the local objects store.
+func (h *handler) Stat(sha256 string) (bool, error) {
+	_, err := os.Stat(*targetDir + "/objects/" + sha256)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (h *handler) Process(downloads <-chan *backend.GogFile, waitGroup *sync.WaitGroup, client *gog.Client) {
+	bar := h.progressPool.Worker()
+
+	for d := range downloads {
+		path := *targetDir + "/" + d.File
+
+		for i := 1; i <= *h.retries; i++ {
+			var err error
+			if h.dedupStore != nil && *h.dedupStore {
+				err = h.processDedup(client, d, path, bar)
+			} else {
+				err = h.processPlain(client, d, path, bar)
+			}
+			if err != nil {
+				log.Printf("Unable to download file: %+v", err)
+				continue
 			}
+
+			// We successfully managed to download this file, skip the rest of our retries.
+			break
 		}
+	}
+
+	waitGroup.Done()
+}
 
-		waitGroup.Done()
+// processPlain downloads d straight into path, resuming an interrupted download and verifying the
+// result against GoG's published checksum. This is the path used when -dedup-store is off.
+func (h *handler) processPlain(client *gog.Client, d *backend.GogFile, path string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
 	}
+
+	// d.File is shared by every download in this platform's list, so a stale ".tmp" left behind in
+	// path might belong to a different, unrelated file; only resume if one matches this d's actual
+	// filename.
+	offset, resuming := findPartialDownload(path, filename)
+	if resuming {
+		readerTmp.Close()
+		readerTmp, err = resumeDownload(client, d.URL, offset)
+		if err != nil {
+			// The range is no longer valid to resume from (e.g. GoG returned a non-206 response),
+			// so drop the stale .tmp and let the next attempt start from scratch instead of
+			// repeating this failure forever.
+			os.Remove(path + "/." + filename + ".tmp")
+			return fmt.Errorf("unable to connect to GoG: %+v", err)
+		}
+	}
+	readerTmp = bar.Wrap(d.Size-offset, readerTmp)
+
+	var reader io.Reader = readerTmp
+	if h.downloadBucket != nil {
+		reader = ratelimit.Reader(reader, h.downloadBucket)
+	}
+
+	// Check for version information from last time.
+	versionFile := path + "/." + filename + ".version"
+	if d.Version != "" {
+		if lastVersion, _ := ioutil.ReadFile(versionFile); string(lastVersion) == d.Version {
+			log.Printf("Skipping %s as it is already up to date.\n", d.Name)
+			readerTmp.Close()
+			return nil
+		}
+	} else if info, _ := os.Stat(path + "/" + filename); info != nil {
+		log.Printf("Skipping %s as it is backed up and isn't versioned.\n", d.Name)
+		readerTmp.Close()
+		return nil
+	}
+
+	version := ""
+	if d.Version != "" {
+		version = " (version: " + color.Purple(d.Version) + ")"
+	}
+	if resuming {
+		fmt.Printf("%s%s\n  resuming at %d bytes %s -> %s\n", d.Name, version, offset, color.LightBlue(d.URL), color.Green(path+"/"+filename))
+	} else {
+		fmt.Printf("%s%s\n  %s -> %s\n", d.Name, version, color.LightBlue(d.URL), color.Green(path+"/"+filename))
+	}
+	err = downloadFile(reader, path, filename, resuming)
+	readerTmp.Close()
+	if err != nil {
+		return err
+	}
+
+	checksum, err := client.FileChecksum(d.URL)
+	if err != nil {
+		log.Printf("Unable to fetch checksum for %s, skipping verification: %+v", d.Name, err)
+	} else if ok, err := gog.VerifyChecksum(path+"/"+filename, checksum); err != nil {
+		log.Printf("Unable to verify checksum for %s: %+v", d.Name, err)
+	} else if !ok {
+		os.Remove(path + "/" + filename)
+		return fmt.Errorf("checksum mismatch for %s, deleting and retrying from scratch", d.Name)
+	}
+
+	if d.Version != "" {
+		// Save version information for next time.
+		if err := ioutil.WriteFile(versionFile, []byte(d.Version), 0666); err != nil {
+			log.Printf("Unable to save version file: %+v", err)
+			// Good enough for this run through - we'll redownload next time and retry saving the version file then.
+		}
+	}
+
+	return nil
 }
 
-func downloadFile(reader io.Reader, path string, filename string) error {
+// processDedup downloads d into the content-addressed objects/<sha256> store, hashing its content
+// with SHA-256 while streaming, and writes path/<filename> as a small manifest pointing at the
+// blob instead of storing the same bytes again for every game or DLC that ships an identical
+// installer. Partial-download resuming isn't supported in this mode: since the blob's name isn't
+// known until the whole file has been hashed, every retry starts the download over.
+func (h *handler) processDedup(client *gog.Client, d *backend.GogFile, path string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
+	}
+
+	// Check for version information from last time, same as processPlain.
+	versionFile := path + "/." + filename + ".version"
+	manifestFile := path + "/" + filename
+	if d.Version != "" {
+		if lastVersion, _ := ioutil.ReadFile(versionFile); string(lastVersion) == d.Version {
+			log.Printf("Skipping %s as it is already up to date.\n", d.Name)
+			readerTmp.Close()
+			return nil
+		}
+	} else if info, _ := os.Stat(manifestFile); info != nil {
+		log.Printf("Skipping %s as it is backed up and isn't versioned.\n", d.Name)
+		readerTmp.Close()
+		return nil
+	}
+
+	readerTmp = bar.Wrap(d.Size, readerTmp)
+	defer readerTmp.Close()
+
+	var reader io.Reader = readerTmp
+	if h.downloadBucket != nil {
+		reader = ratelimit.Reader(reader, h.downloadBucket)
+	}
+
+	hasher := sha256.New()
+	tee := io.TeeReader(reader, hasher)
+
+	objectsDir := *targetDir + "/objects"
+	if err := os.MkdirAll(objectsDir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n  %s -> %s\n", d.Name, color.LightBlue(d.URL), color.Green(path+"/"+filename))
+
+	// Staged under .dedup-incoming/<d.File> rather than directly in objectsDir, so two workers
+	// downloading different games/extras that happen to share a generic filename (e.g.
+	// "manual.pdf") don't write over each other before the content hash is known.
+	incomingDir := *targetDir + "/.dedup-incoming/" + d.File
+	if err := os.MkdirAll(incomingDir, os.ModePerm); err != nil {
+		return err
+	}
+	incoming := incomingDir + "/" + filename
+	out, err := os.OpenFile(incoming, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, tee); err != nil {
+		out.Close()
+		os.Remove(incoming)
+		return err
+	}
+	out.Close()
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	exists, err := h.Stat(sum)
+	if err != nil {
+		os.Remove(incoming)
+		return err
+	}
+	if exists {
+		os.Remove(incoming)
+	} else if err := os.Rename(incoming, objectsDir+"/"+sum); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(manifestFile, []byte("objects/"+sum+"\n"), 0666); err != nil {
+		return err
+	}
+
+	if d.Version != "" {
+		// Save version information for next time.
+		if err := ioutil.WriteFile(versionFile, []byte(d.Version), 0666); err != nil {
+			log.Printf("Unable to save version file: %+v", err)
+			// Good enough for this run through - we'll redownload next time and retry saving the version file then.
+		}
+	}
+
+	return nil
+}
+
+// findPartialDownload reports whether a ".tmp" file left behind by an interrupted download of
+// filename already exists in dir, and if so the number of bytes already written, so the download
+// can be resumed instead of restarted.
+func findPartialDownload(dir string, filename string) (int64, bool) {
+	info, err := os.Stat(dir + "/." + filename + ".tmp")
+	if err != nil {
+		return 0, false
+	}
+
+	return info.Size(), true
+}
+
+func resumeDownload(client *gog.Client, url string, offset int64) (io.ReadCloser, error) {
+	_, reader, err := client.DownloadFileRange(url, offset)
+	return reader, err
+}
+
+func downloadFile(reader io.Reader, path string, filename string, resuming bool) error {
 	if filename == "" {
 		return fmt.Errorf("No filename available, skipping this file")
 	}
@@ -97,7 +282,13 @@ func downloadFile(reader io.Reader, path string, filename string) error {
 
 	tmpfile := path + "/." + filename + ".tmp"
 	outfile := path + "/" + filename
-	writer, err := os.OpenFile(tmpfile, os.O_WRONLY|os.O_CREATE, 0666)
+	flags := os.O_WRONLY | os.O_CREATE
+	if resuming {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	writer, err := os.OpenFile(tmpfile, flags, 0666)
 	if err != nil {
 		return err
 	}
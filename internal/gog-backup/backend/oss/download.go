@@ -0,0 +1,222 @@
+package oss
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"sync"
+
+	"github.com/bclicn/color"
+	aliyunoss "github.com/denverdino/aliyungo/oss"
+	"github.com/mscharley/gog-backup/internal/gog-backup/backend"
+	"github.com/mscharley/gog-backup/internal/gog-backup/progress"
+	"github.com/mscharley/gog-backup/pkg/gog"
+)
+
+var (
+	bucketName      = flag.String("oss-bucket", "", "The bucket to upload to. (backend=oss)")
+	prefix          = flag.String("oss-prefix", "", "A prefix path to upload into a directory. (backend=oss)")
+	region          = flag.String("oss-region", string(aliyunoss.Hangzhou), "The OSS region to connect to. (backend=oss)")
+	accessKeyID     = flag.String("oss-access-key-id", "", "The access key ID for the Aliyun account. (backend=oss)")
+	accessKeySecret = flag.String("oss-access-key-secret", "", "The access key secret for the Aliyun account. (backend=oss)")
+)
+
+func init() {
+	backend.Register("oss", func() (backend.Handler, error) {
+		return DownloadFile(backend.Shared.Retries, backend.Shared.Progress, backend.Shared.DedupStore)
+	})
+}
+
+// handler is the oss backend's Handler. This backend downloads all the files from GoG and stores
+// them as objects in an Aliyun OSS bucket.
+type handler struct {
+	retries      *int
+	progressPool *progress.Pool
+	dedupStore   *bool
+	bkt          *aliyunoss.Bucket
+}
+
+// DownloadFile is the entrypoint for the oss backend.
+func DownloadFile(retries *int, progressPool *progress.Pool, dedupStore *bool) (backend.Handler, error) {
+	client := aliyunoss.NewOSSClient(aliyunoss.Region(*region), false, *accessKeyID, *accessKeySecret, true)
+	bkt := client.Bucket(*bucketName)
+
+	return &handler{retries: retries, progressPool: progressPool, dedupStore: dedupStore, bkt: bkt}, nil
+}
+
+func (h *handler) readObject(name string) (string, error) {
+	body, err := h.bkt.Get(name)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (h *handler) objectExists(name string) bool {
+	_, err := h.bkt.GetResponse(name)
+	return err == nil
+}
+
+// Stat reports whether the blob for sha256 already exists in the bucket's objects/ store.
+func (h *handler) Stat(sha256 string) (bool, error) {
+	return h.objectExists(path.Join(*prefix, "objects", sha256)), nil
+}
+
+func (h *handler) Process(downloads <-chan *backend.GogFile, waitGroup *sync.WaitGroup, client *gog.Client) {
+	bar := h.progressPool.Worker()
+
+	for d := range downloads {
+		basepath := d.File
+		if *prefix != "" {
+			basepath = path.Join(*prefix, basepath)
+		}
+
+		for i := 1; i <= *h.retries; i++ {
+			var err error
+			if h.dedupStore != nil && *h.dedupStore {
+				err = h.processDedup(client, d, basepath, bar)
+			} else {
+				err = h.processPlain(client, d, basepath, bar)
+			}
+			if err != nil {
+				log.Printf("Unable to download file: %+v", err)
+				continue
+			}
+
+			// We successfully managed to download this file, skip the rest of our retries.
+			break
+		}
+	}
+
+	waitGroup.Done()
+}
+
+// alreadyUpToDate reads back the ".version" sidecar object that processPlain and processDedup write
+// for every versioned file, and reports true once its contents match d.Version.
+func (h *handler) alreadyUpToDate(basepath string, filename string, d *backend.GogFile) bool {
+	if d.Version != "" {
+		versionObject := path.Join(basepath, "."+filename+".version")
+		if lastVersion, _ := h.readObject(versionObject); lastVersion == d.Version {
+			log.Printf("Skipping %s as it is already up to date.\n", d.Name)
+			return true
+		}
+		return false
+	}
+	if h.objectExists(path.Join(basepath, filename)) {
+		log.Printf("Skipping %s as it is already backed up and isn't versioned.\n", d.Name)
+		return true
+	}
+	return false
+}
+
+func (h *handler) processPlain(client *gog.Client, d *backend.GogFile, basepath string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
+	}
+	readerTmp = bar.Wrap(d.Size, readerTmp)
+
+	if h.alreadyUpToDate(basepath, filename, d) {
+		readerTmp.Close()
+		return nil
+	}
+	versionObject := path.Join(basepath, "."+filename+".version")
+
+	version := ""
+	if d.Version != "" {
+		version = " (version: " + color.Purple(d.Version) + ")"
+	}
+	key := path.Join(basepath, filename)
+	tmpKey := path.Join(basepath, "."+filename+".tmp")
+	fmt.Printf("%s%s\n  %s -> %s\n", d.Name, version, color.LightBlue(d.URL), color.Green("oss://"+*bucketName+"/"+key))
+
+	body, err := ioutil.ReadAll(readerTmp)
+	readerTmp.Close()
+	if err != nil {
+		return fmt.Errorf("unable to download file: %+v", err)
+	}
+
+	if err := h.bkt.Put(tmpKey, body, "application/octet-stream", aliyunoss.Private, aliyunoss.Options{}); err != nil {
+		return fmt.Errorf("unable to upload file: %+v", err)
+	}
+
+	if _, err := h.bkt.PutCopy(key, aliyunoss.Private, aliyunoss.CopyOptions{}, path.Join(*bucketName, tmpKey)); err != nil {
+		return fmt.Errorf("unable to rename uploaded file: %+v", err)
+	}
+	h.bkt.Del(tmpKey)
+
+	if d.Version != "" {
+		if err := h.bkt.Put(versionObject, []byte(d.Version), "text/plain", aliyunoss.Private, aliyunoss.Options{}); err != nil {
+			log.Printf("Unable to save version object: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// processDedup buffers d under a tmp key while hashing it with SHA-256, copies it into
+// objects/<sha256> unless that object is already there, then drops the tmp key and leaves a
+// manifest object at the logical key. This mode doesn't fetch or check GoG's own checksum, and the
+// SHA-256 is only used to name the object.
+func (h *handler) processDedup(client *gog.Client, d *backend.GogFile, basepath string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
+	}
+
+	if h.alreadyUpToDate(basepath, filename, d) {
+		readerTmp.Close()
+		return nil
+	}
+	readerTmp = bar.Wrap(d.Size, readerTmp)
+	defer readerTmp.Close()
+
+	hasher := sha256.New()
+	tee := io.TeeReader(readerTmp, hasher)
+
+	body, err := ioutil.ReadAll(tee)
+	if err != nil {
+		return fmt.Errorf("unable to download file: %+v", err)
+	}
+
+	key := path.Join(basepath, filename)
+	fmt.Printf("%s\n  %s -> %s (deduping)\n", d.Name, color.LightBlue(d.URL), color.Green("oss://"+*bucketName+"/"+key))
+
+	tmpKey := path.Join(*prefix, ".dedup-incoming", basepath, filename)
+	if err := h.bkt.Put(tmpKey, body, "application/octet-stream", aliyunoss.Private, aliyunoss.Options{}); err != nil {
+		return fmt.Errorf("unable to upload file: %+v", err)
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	exists, err := h.Stat(sum)
+	if err != nil {
+		return err
+	}
+	if exists {
+		h.bkt.Del(tmpKey)
+	} else {
+		objectKey := path.Join(*prefix, "objects", sum)
+		if _, err := h.bkt.PutCopy(objectKey, aliyunoss.Private, aliyunoss.CopyOptions{}, path.Join(*bucketName, tmpKey)); err != nil {
+			return fmt.Errorf("unable to rename uploaded file: %+v", err)
+		}
+		h.bkt.Del(tmpKey)
+	}
+
+	if err := h.bkt.Put(key, []byte("objects/"+sum+"\n"), "text/plain", aliyunoss.Private, aliyunoss.Options{}); err != nil {
+		return err
+	}
+
+	if d.Version != "" {
+		versionObject := path.Join(basepath, "."+filename+".version")
+		if err := h.bkt.Put(versionObject, []byte(d.Version), "text/plain", aliyunoss.Private, aliyunoss.Options{}); err != nil {
+			log.Printf("Unable to save version object: %+v", err)
+		}
+	}
+
+	return nil
+}
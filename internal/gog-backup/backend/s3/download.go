@@ -1,6 +1,11 @@
 package s3
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -17,28 +22,85 @@ import (
 	"github.com/bclicn/color"
 	"github.com/juju/ratelimit"
 	"github.com/mscharley/gog-backup/internal/gog-backup/backend"
+	"github.com/mscharley/gog-backup/internal/gog-backup/progress"
 	"github.com/mscharley/gog-backup/pkg/gog"
 )
 
+// gogVersionMetadataKey is the user metadata key (sent as the x-amz-meta-gog-version header)
+// objects are tagged with, so version comparisons don't need a sidecar object.
+const gogVersionMetadataKey = "Gog-Version"
+
 var (
-	bucket = flag.String("s3-bucket", "", "The bucket to upload to. (backend=s3)")
-	prefix = flag.String("s3-prefix", "", "A prefix path to upload into a directory. (backend=s3)")
+	bucket       = flag.String("s3-bucket", "", "The bucket to upload to. (backend=s3)")
+	prefix       = flag.String("s3-prefix", "", "A prefix path to upload into a directory. (backend=s3)")
+	endpoint     = flag.String("s3-endpoint", "", "A custom endpoint URL, for S3-compatible services such as Wasabi, Backblaze B2 or MinIO. (backend=s3)")
+	storageClass = flag.String("s3-storage-class", s3.StorageClassStandard, "The storage class to upload objects with: STANDARD, STANDARD_IA, GLACIER or DEEP_ARCHIVE. (backend=s3)")
+	sse          = flag.String("s3-sse", "", "Server-side encryption to apply to uploaded objects: AES256 or aws:kms. (default: none) (backend=s3)")
+	kmsKeyID     = flag.String("s3-kms-key-id", "", "The KMS key ID to encrypt with when -s3-sse=aws:kms. (backend=s3)")
+	partSizeMB   = flag.Int64("s3-part-size-mb", 64, "The size in MiB of each part in a multipart upload. (backend=s3)")
+	concurrency  = flag.Int("s3-concurrency", 4, "How many parts of a file to upload concurrently. (backend=s3)")
 )
 
-func DownloadFile(retries *int, uploadBucket *ratelimit.Bucket, downloadBucket *ratelimit.Bucket) (backend.Handler, error) {
-	// The session for S3.
-	sess := session.Must(session.NewSession())
-	region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, *bucket, "us-east-1")
-	if err != nil {
-		return nil, err
+func init() {
+	backend.Register("s3", func() (backend.Handler, error) {
+		return DownloadFile(backend.Shared.Retries, backend.Shared.UploadBucket, backend.Shared.DownloadBucket, backend.Shared.Progress, backend.Shared.DedupStore)
+	})
+}
+
+// multipartResume tracks the parts already uploaded for an in-progress multipart upload, stored as
+// a small sidecar object so the upload can be continued after a restart instead of redone from the
+// beginning.
+type multipartResume struct {
+	UploadID string                `json:"uploadId"`
+	Parts    []multipartResumePart `json:"parts"`
+}
+
+type multipartResumePart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// handler is the s3 backend's Handler. The closures it holds are built once in DownloadFile, where
+// they can share the bucket's session and region without every call having to rediscover them.
+type handler struct {
+	retries      *int
+	progressPool *progress.Pool
+	dedupStore   *bool
+	uploadBucket *ratelimit.Bucket
+
+	svc                *s3.S3
+	readFile           func(key string) (string, error)
+	writeFile          func(key string, content string) error
+	writeFileVersioned func(key string, content string, version string) error
+	headObject         func(key string) (version string, exists bool, err error)
+	download           func(client *gog.Client, url string, checksum string, basepath string, filename string, version string, size int64, bar *progress.WorkerBar, initialBody io.ReadCloser) error
+}
+
+func DownloadFile(retries *int, uploadBucket *ratelimit.Bucket, downloadBucket *ratelimit.Bucket, progressPool *progress.Pool, dedupStore *bool) (backend.Handler, error) {
+	// The session for S3. A custom -s3-endpoint also needs path-style addressing, since
+	// S3-compatible services (Wasabi, Backblaze B2, MinIO) generally don't support the
+	// <bucket>.<endpoint> virtual-host form AWS defaults to.
+	cfg := &aws.Config{}
+	if *endpoint != "" {
+		cfg.Endpoint = aws.String(*endpoint)
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess := session.Must(session.NewSession(cfg))
+
+	region := "us-east-1"
+	if *endpoint == "" {
+		detected, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, *bucket, region)
+		if err != nil {
+			return nil, err
+		}
+		region = detected
 	}
 	log.Printf("Detected s3://%s in region %s\n", *bucket, region)
 	sess.Config.Region = &region
 	svc := s3.New(sess)
 
 	// Create an interface with S3
-	uploader := s3manager.NewUploader(sess)
-	_ = uploader
 	downloader := s3manager.NewDownloader(sess)
 
 	readFile := func(filename string) (string, error) {
@@ -55,134 +117,485 @@ func DownloadFile(retries *int, uploadBucket *ratelimit.Bucket, downloadBucket *
 		return strings.TrimRight(string(buff.Bytes()), "\x00"), nil
 	}
 
-	fileExists := func(filename string) (bool, error) {
-		_, err = svc.HeadObject(&s3.HeadObjectInput{
+	writeFile := func(filename string, content string) error {
+		_, err := s3manager.NewUploader(sess).Upload(&s3manager.UploadInput{
 			Bucket: aws.String(*bucket),
 			Key:    aws.String(filename),
+			Body:   strings.NewReader(content),
 		})
 
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchKey:
-				return false, nil
-			default:
-				return false, err
-			}
+		return err
+	}
+
+	// writeFileVersioned is writeFile plus the gog-version metadata, so a manifest object written in
+	// -dedup-store mode can be skipped by headObject on a later run the same way a plain upload is.
+	writeFileVersioned := func(filename string, content string, version string) error {
+		input := &s3manager.UploadInput{
+			Bucket: aws.String(*bucket),
+			Key:    aws.String(filename),
+			Body:   strings.NewReader(content),
+		}
+		if version != "" {
+			input.Metadata = map[string]*string{gogVersionMetadataKey: aws.String(version)}
 		}
+		_, err := s3manager.NewUploader(sess).Upload(input)
+
+		return err
+	}
 
+	// headObject returns the gog-version metadata of an object along with whether it exists at
+	// all, so the handler can tell "not backed up yet" apart from "backed up, but by a version of
+	// gog-backup that wrote a .version sidecar instead of this metadata".
+	headObject := func(key string) (version string, exists bool, err error) {
+		out, err := svc.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(*bucket),
+			Key:    aws.String(key),
+		})
+
+		// HeadObject responses carry no body, so a missing key comes back as "NotFound" rather
+		// than NoSuchKey.
+		if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound") {
+			return "", false, nil
+		}
 		if err != nil {
-			return false, err
+			return "", false, err
+		}
+
+		if v, ok := out.Metadata[gogVersionMetadataKey]; ok && v != nil {
+			return *v, true, nil
 		}
-		return true, nil
+		return "", true, nil
 	}
 
-	writeFile := func(filename string, content string) error {
-		_, err := uploader.Upload(&s3manager.UploadInput{
+	resumeState := func(key string) *multipartResume {
+		contents, err := readFile(key + ".upload")
+		if err != nil || contents == "" {
+			return nil
+		}
+
+		state := &multipartResume{}
+		if err := json.Unmarshal([]byte(contents), state); err != nil {
+			return nil
+		}
+
+		return state
+	}
+
+	saveResumeState := func(key string, state *multipartResume) {
+		body, err := json.Marshal(state)
+		if err != nil {
+			return
+		}
+		if err := writeFile(key+".upload", string(body)); err != nil {
+			log.Printf("Unable to save upload resume state: %+v", err)
+		}
+	}
+
+	clearResumeState := func(key string) {
+		svc.DeleteObject(&s3.DeleteObjectInput{
 			Bucket: aws.String(*bucket),
-			Key:    aws.String(filename),
-			Body:   strings.NewReader(content),
+			Key:    aws.String(key + ".upload"),
 		})
+	}
 
-		return err
+	// verifyObject reads key back and returns its MD5 hash, for verifying a resumed upload whose
+	// earlier parts were never hashed by this process.
+	verifyObject := func(key string) (string, error) {
+		out, err := svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(*bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return "", err
+		}
+		defer out.Body.Close()
+
+		hasher := md5.New()
+		if _, err := io.Copy(hasher, out.Body); err != nil {
+			return "", err
+		}
+
+		return hex.EncodeToString(hasher.Sum(nil)), nil
 	}
 
-	downloadFile := func(reader io.Reader, basepath string, filename string) error {
-		tmpKey := path.Join(basepath, "."+filename+".tmp")
+	// download streams a GoG download straight into an S3 multipart upload at its final key,
+	// resuming an in-progress upload (and the matching GoG range request) when a previous attempt
+	// left one behind, and verifying the result against GoG's published checksum: before completing
+	// the upload for a fresh upload, or by reading the completed object back for a resumed one. The
+	// object only becomes visible once the multipart upload completes, so there's no need for a
+	// tmp-key-then-copy dance to hide a partial upload. initialBody is the reader the caller already
+	// opened with a plain (non-Range) request to learn filename; it's reused directly when there's
+	// nothing to resume, so a download that isn't resumed only opens one GoG download request.
+	download := func(client *gog.Client, url string, checksum string, basepath string, filename string, version string, size int64, bar *progress.WorkerBar, initialBody io.ReadCloser) error {
 		key := path.Join(basepath, filename)
-		var Body io.Reader
-		if uploadBucket == nil {
-			Body = reader
+
+		state := resumeState(key)
+		var offset int64
+		for _, part := range state.partsOrEmpty() {
+			offset += part.Size
+		}
+
+		var body io.ReadCloser
+		var err error
+		if state != nil {
+			initialBody.Close()
+			_, body, err = client.DownloadFileRange(url, offset)
 		} else {
-			Body = ratelimit.Reader(reader, uploadBucket)
+			body = initialBody
 		}
+		if err != nil {
+			return err
+		}
+		body = bar.Wrap(size-offset, body)
+		defer body.Close()
 
-		_, err := uploader.Upload(&s3manager.UploadInput{
-			Bucket: aws.String(*bucket),
-			Key:    aws.String(tmpKey),
-			Body:   Body,
-		})
+		var reader io.Reader = body
+		if uploadBucket != nil {
+			reader = ratelimit.Reader(reader, uploadBucket)
+		}
 
+		hasher := md5.New()
+		resuming := state != nil
+		if resuming {
+			// We can't re-hash bytes that were uploaded in a previous process, so this upload is
+			// verified after the fact instead, by reading the completed object back.
+			hasher = nil
+		} else {
+			reader = io.TeeReader(reader, hasher)
+		}
+
+		state, err = uploadMultipart(svc, *bucket, key, reader, state, version, *partSizeMB*1024*1024, func(s *multipartResume) {
+			saveResumeState(key, s)
+		})
 		if err != nil {
 			return err
 		}
 
-		defer svc.DeleteObject(&s3.DeleteObjectInput{
-			Bucket: aws.String(*bucket),
-			Key:    aws.String(tmpKey),
-		})
+		if hasher != nil && checksum != "" {
+			if sum := hex.EncodeToString(hasher.Sum(nil)); sum != checksum {
+				svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+					Bucket:   aws.String(*bucket),
+					Key:      aws.String(key),
+					UploadId: aws.String(state.UploadID),
+				})
+				clearResumeState(key)
+				return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filename, checksum, sum)
+			}
+		}
 
-		_, err = svc.CopyObject(&s3.CopyObjectInput{
-			Bucket:     aws.String(*bucket),
-			CopySource: aws.String("/" + *bucket + "/" + tmpKey),
-			Key:        aws.String(key),
-		})
+		if err := completeMultipart(svc, *bucket, key, state); err != nil {
+			return err
+		}
+		clearResumeState(key)
+
+		if resuming && checksum != "" {
+			sum, verr := verifyObject(key)
+			if verr != nil {
+				log.Printf("Unable to verify checksum for %s: %+v", filename, verr)
+			} else if sum != checksum {
+				svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(*bucket), Key: aws.String(key)})
+				return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filename, checksum, sum)
+			}
+		}
+
+		return nil
+	}
+
+	return &handler{
+		retries:            retries,
+		progressPool:       progressPool,
+		dedupStore:         dedupStore,
+		uploadBucket:       uploadBucket,
+		svc:                svc,
+		readFile:           readFile,
+		writeFile:          writeFile,
+		writeFileVersioned: writeFileVersioned,
+		headObject:         headObject,
+		download:           download,
+	}, nil
+}
+
+// Stat reports whether the blob for sha256 already exists in the bucket's objects/ store.
+func (h *handler) Stat(sha256 string) (bool, error) {
+	_, exists, err := h.headObject(path.Join(*prefix, "objects", sha256))
+	return exists, err
+}
+
+func (h *handler) Process(downloads <-chan *backend.GogFile, waitGroup *sync.WaitGroup, client *gog.Client) {
+	bar := h.progressPool.Worker()
+
+	for d := range downloads {
+		basepath := d.File
+		if *prefix != "" {
+			basepath = path.Join(*prefix, basepath)
+		}
+
+		for i := 1; i <= *h.retries; i++ {
+			var err error
+			if h.dedupStore != nil && *h.dedupStore {
+				err = h.processDedup(client, d, basepath, bar)
+			} else {
+				err = h.processPlain(client, d, basepath, bar)
+			}
+			if err != nil {
+				log.Printf("Unable to download file: %+v", err)
+				continue
+			}
+
+			// We successfully managed to download this file, skip the rest of our retries.
+			break
+		}
+	}
+
+	waitGroup.Done()
+}
+
+// alreadyUpToDate reports whether key already holds the current version of d, checked via its
+// x-amz-meta-gog-version metadata with a fallback to the sidecar ".version" file written by legacy
+// gog-backup versions, so an existing backup isn't needlessly re-uploaded after upgrading.
+func (h *handler) alreadyUpToDate(key string, basepath string, filename string, d *backend.GogFile) bool {
+	existingVersion, exists, err := h.headObject(key)
+	if err != nil {
+		log.Printf("Unable to check for an existing backup of %s: %+v", d.Name, err)
+		return false
+	}
+	if !exists {
+		return false
+	}
+	if d.Version == "" {
+		log.Printf("Skipping %s as it is already backed up and isn't versioned.\n", d.Name)
+		return true
+	}
+	if existingVersion == d.Version {
+		log.Printf("Skipping %s as it is already up to date.\n", d.Name)
+		return true
+	}
+	if existingVersion == "" {
+		legacyVersionFile := path.Join(basepath, "."+filename+".version")
+		if legacy, _ := h.readFile(legacyVersionFile); legacy == d.Version {
+			log.Printf("Skipping %s as it is already up to date.\n", d.Name)
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handler) processPlain(client *gog.Client, d *backend.GogFile, basepath string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
+	}
+
+	key := path.Join(basepath, filename)
+	if h.alreadyUpToDate(key, basepath, filename, d) {
+		readerTmp.Close()
+		return nil
+	}
+
+	version := ""
+	if d.Version != "" {
+		version = " (version: " + color.Purple(d.Version) + ")"
+	}
+	fmt.Printf("%s%s\n  %s -> %s\n", d.Name, version, color.LightBlue(d.URL), color.Green("s3://"+*bucket+"/"+key))
+
+	checksum, err := client.FileChecksum(d.URL)
+	if err != nil {
+		log.Printf("Unable to fetch checksum for %s, skipping verification: %+v", d.Name, err)
+		checksum = ""
+	}
+
+	return h.download(client, d.URL, checksum, basepath, filename, d.Version, d.Size, bar, readerTmp)
+}
+
+// processDedup downloads d into a staging key, hashes it with SHA-256 while it uploads, then
+// promotes it to objects/<sha256> (or discards it if that blob already exists) and writes the
+// logical key as a small manifest object pointing at the blob. GoG's published checksum isn't
+// verified in this mode, and the content hash is only used to name the blob; it isn't compared
+// against anything.
+func (h *handler) processDedup(client *gog.Client, d *backend.GogFile, basepath string, bar *progress.WorkerBar) error {
+	filename, readerTmp, err := client.DownloadFile(d.URL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to GoG: %+v", err)
+	}
+
+	key := path.Join(basepath, filename)
+	if h.alreadyUpToDate(key, basepath, filename, d) {
+		readerTmp.Close()
+		return nil
+	}
+
+	readerTmp = bar.Wrap(d.Size, readerTmp)
+	defer readerTmp.Close()
+
+	var reader io.Reader = readerTmp
+	if h.uploadBucket != nil {
+		reader = ratelimit.Reader(reader, h.uploadBucket)
+	}
+
+	hasher := sha256.New()
+	reader = io.TeeReader(reader, hasher)
+
+	fmt.Printf("%s\n  %s -> %s (deduping)\n", d.Name, color.LightBlue(d.URL), color.Green("s3://"+*bucket+"/"+key))
+
+	stagingKey := path.Join(*prefix, ".dedup-incoming", basepath, filename)
+	state, err := uploadMultipart(h.svc, *bucket, stagingKey, reader, nil, "", *partSizeMB*1024*1024, func(*multipartResume) {})
+	if err != nil {
+		return err
+	}
+	if err := completeMultipart(h.svc, *bucket, stagingKey, state); err != nil {
 		return err
 	}
 
-	handler := func(downloads <-chan *backend.GogFile, waitGroup *sync.WaitGroup, client *gog.Client) {
-		for d := range downloads {
-			basepath := d.File
-			if *prefix != "" {
-				basepath = path.Join(*prefix, basepath)
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	exists, err := h.Stat(sum)
+	if err != nil {
+		return err
+	}
+	if exists {
+		h.svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(*bucket), Key: aws.String(stagingKey)})
+	} else {
+		objectKey := path.Join(*prefix, "objects", sum)
+		if _, err := h.svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(*bucket),
+			CopySource: aws.String("/" + *bucket + "/" + stagingKey),
+			Key:        aws.String(objectKey),
+		}); err != nil {
+			return err
+		}
+		h.svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(*bucket), Key: aws.String(stagingKey)})
+	}
+
+	return h.writeFileVersioned(key, "objects/"+sum+"\n", d.Version)
+}
+
+func (state *multipartResume) partsOrEmpty() []multipartResumePart {
+	if state == nil {
+		return nil
+	}
+	return state.Parts
+}
+
+// uploadMultipart streams reader into S3 as a series of parts, creating a new multipart upload (or
+// continuing from state if one is supplied) with the configured storage class and server-side
+// encryption, tagging a fresh upload with the GoG version as object metadata. Up to concurrency
+// parts are uploaded in parallel per batch; progressFn is called after each batch completes so the
+// caller can persist resume state to survive a restart.
+func uploadMultipart(svc *s3.S3, bucket string, key string, reader io.Reader, state *multipartResume, version string, partSize int64, progressFn func(*multipartResume)) (*multipartResume, error) {
+	if state == nil {
+		input := &s3.CreateMultipartUploadInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			StorageClass: aws.String(*storageClass),
+		}
+		if version != "" {
+			input.Metadata = map[string]*string{gogVersionMetadataKey: aws.String(version)}
+		}
+		if *sse != "" {
+			input.ServerSideEncryption = aws.String(*sse)
+			if *kmsKeyID != "" {
+				input.SSEKMSKeyId = aws.String(*kmsKeyID)
 			}
+		}
 
-			for i := 1; i <= *retries; i++ {
-				filename, readerTmp, err := client.DownloadFile(d.URL)
-				var reader io.Reader
-				if downloadBucket == nil {
-					reader = readerTmp
-				} else {
-					reader = ratelimit.Reader(readerTmp, downloadBucket)
-				}
+		out, err := svc.CreateMultipartUpload(input)
+		if err != nil {
+			return nil, err
+		}
+		state = &multipartResume{UploadID: *out.UploadId}
+	}
 
-				if err != nil {
-					log.Printf("Unable to connect to GoG: %+v", err)
-					continue
-				}
+	batchSize := *concurrency
+	if batchSize < 1 {
+		batchSize = 1
+	}
 
-				// Check for version information from last time.
-				versionFile := path.Join(basepath, "."+filename+".version")
-				if d.Version != "" {
-					if lastVersion, _ := readFile(versionFile); string(lastVersion) == d.Version {
-						log.Printf("Skipping %s as it is already up to date.\n", d.Name)
-						readerTmp.Close()
-						break
+	partNumber := int64(len(state.Parts)) + 1
+	for {
+		type chunk struct {
+			number int64
+			data   []byte
+		}
+		batch := make([]chunk, 0, batchSize)
+		done := false
+		for len(batch) < batchSize {
+			buf := make([]byte, partSize)
+			n, err := io.ReadFull(reader, buf)
+			if n > 0 {
+				batch = append(batch, chunk{number: partNumber, data: buf[:n]})
+				partNumber++
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				done = true
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(batch) > 0 {
+			parts := make([]multipartResumePart, len(batch))
+			errs := make([]error, len(batch))
+			var wg sync.WaitGroup
+			for i, c := range batch {
+				wg.Add(1)
+				go func(i int, c chunk) {
+					defer wg.Done()
+					out, uerr := svc.UploadPart(&s3.UploadPartInput{
+						Bucket:     aws.String(bucket),
+						Key:        aws.String(key),
+						UploadId:   aws.String(state.UploadID),
+						PartNumber: aws.Int64(c.number),
+						Body:       bytes.NewReader(c.data),
+					})
+					if uerr != nil {
+						errs[i] = uerr
+						return
 					}
-				} else if info, _ := fileExists(path.Join(basepath, filename)); info {
-					log.Printf("Skipping %s as it is already backed up and isn't versioned.\n", d.Name)
-					readerTmp.Close()
-					break
-				}
+					parts[i] = multipartResumePart{
+						Number: c.number,
+						ETag:   *out.ETag,
+						Size:   int64(len(c.data)),
+					}
+				}(i, c)
+			}
+			wg.Wait()
 
-				version := ""
-				if d.Version != "" {
-					version = " (version: " + color.Purple(d.Version) + ")"
-				}
-				fmt.Printf("%s%s\n  %s -> %s\n", d.Name, version, color.LightBlue(d.URL), color.Green("s3://"+*bucket+"/"+path.Join(basepath, filename)))
-				err = downloadFile(reader, basepath, filename)
-				readerTmp.Close()
+			for _, err := range errs {
 				if err != nil {
-					log.Printf("Unable to download file: %+v", err)
-					continue
+					return nil, err
 				}
+			}
 
-				if d.Version != "" {
-					// Save version information for next time.
-					err = writeFile(versionFile, d.Version)
-					if err != nil {
-						log.Printf("Unable to save version file: %+v", err)
-						// Good enough for this run through - we'll redownload next time and retry saving the version file then.
-						break
-					}
-				}
+			state.Parts = append(state.Parts, parts...)
+			progressFn(state)
+		}
 
-				// We successfully managed to download this file, skip the rest of our retries.
-				break
-			}
+		if done {
+			break
 		}
+	}
+
+	return state, nil
+}
 
-		waitGroup.Done()
+func completeMultipart(svc *s3.S3, bucket string, key string, state *multipartResume) error {
+	parts := make([]*s3.CompletedPart, len(state.Parts))
+	for i, part := range state.Parts {
+		parts[i] = &s3.CompletedPart{
+			PartNumber: aws.Int64(part.Number),
+			ETag:       aws.String(part.ETag),
+		}
 	}
 
-	return handler, nil
+	_, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: parts,
+		},
+	})
+
+	return err
 }
@@ -0,0 +1,147 @@
+// Package progress renders download throughput for gog-backup using a github.com/cheggaaa/pb/v3
+// bar pool: one bar per concurrent download worker plus an aggregate bar tracking bytes
+// transferred across every worker. It is deliberately tolerant of being disabled (--no-progress)
+// so callers never need to branch on whether a terminal is attached.
+package progress
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cheggaaa/pb/v3"
+)
+
+// Pool owns the bars for every concurrent download worker plus the aggregate bar. Construct one
+// with New and hand each worker goroutine its own bar via Worker.
+type Pool struct {
+	enabled    bool
+	pool       *pb.Pool
+	total      *pb.ProgressBar
+	grandTotal int64
+	bars       chan *pb.ProgressBar
+}
+
+// New creates a Pool sized for workers concurrent downloads. If enabled is false (set via
+// --no-progress), the returned Pool renders nothing and every WorkerBar it hands out is a no-op
+// passthrough, so backends don't need to special-case progress reporting being off.
+func New(workers int, enabled bool) (*Pool, error) {
+	p := &Pool{enabled: enabled}
+	if !enabled {
+		return p, nil
+	}
+
+	bars := make([]*pb.ProgressBar, 0, workers+1)
+	p.bars = make(chan *pb.ProgressBar, workers)
+	for i := 0; i < workers; i++ {
+		bar := pb.New64(0).Set(pb.Bytes, true)
+		bars = append(bars, bar)
+		p.bars <- bar
+	}
+
+	p.total = pb.New64(0).Set(pb.Bytes, true).Set("prefix", "Total ")
+	bars = append(bars, p.total)
+
+	pool, err := pb.StartPool(bars...)
+	if err != nil {
+		return nil, err
+	}
+	p.pool = pool
+
+	return p, nil
+}
+
+// Worker hands a backend handler goroutine one of the pool's bars, meant to be fetched once per
+// goroutine and reused for every download it processes. On a disabled Pool (or a nil *Pool) it
+// returns nil, and every *WorkerBar method tolerates that as a passthrough.
+func (p *Pool) Worker() *WorkerBar {
+	if p == nil || !p.enabled {
+		return nil
+	}
+
+	return &WorkerBar{bar: <-p.bars, total: p.total, grandTotal: &p.grandTotal}
+}
+
+// Finish stops every bar in the pool, restoring the terminal to a normal state. Safe to call on a
+// disabled or nil Pool.
+func (p *Pool) Finish() {
+	if p == nil || !p.enabled {
+		return
+	}
+	p.pool.Stop()
+}
+
+// WorkerBar is a single worker's progress bar, handed out by Pool.Worker.
+type WorkerBar struct {
+	bar        *pb.ProgressBar
+	total      *pb.ProgressBar
+	grandTotal *int64
+}
+
+// Wrap resets the worker's bar to track size bytes, grows the aggregate bar's total by the same
+// amount, and returns reader wrapped so reads advance both bars. A nil WorkerBar returns reader
+// unchanged.
+func (w *WorkerBar) Wrap(size int64, reader io.ReadCloser) io.ReadCloser {
+	if w == nil {
+		return reader
+	}
+
+	w.bar.SetCurrent(0)
+	w.bar.SetTotal(size)
+	w.total.SetTotal(atomic.AddInt64(w.grandTotal, size))
+
+	return &aggregateReader{Reader: w.bar.NewProxyReader(reader), total: w.total}
+}
+
+// aggregateReader mirrors every read a worker's pb.Reader reports into the pool's aggregate bar,
+// so the totals bar reflects bytes moved by every worker rather than just this one.
+type aggregateReader struct {
+	*pb.Reader
+	total *pb.ProgressBar
+}
+
+func (r *aggregateReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.total.Add(n)
+	}
+	return n, err
+}
+
+// sizeUnits maps the unit suffixes GoG uses in its human-readable "size" fields to a byte
+// multiplier.
+var sizeUnits = map[string]int64{
+	"B":  1,
+	"KB": 1024,
+	"MB": 1024 * 1024,
+	"GB": 1024 * 1024 * 1024,
+	"TB": 1024 * 1024 * 1024 * 1024,
+}
+
+// ParseSize converts one of GoG's human-readable sizes (e.g. "1.2 GB") into a byte count, for
+// seeding a bar's total. It's best-effort: a size GoG formats in a way this doesn't recognise
+// parses to 0, which simply leaves that file out of the aggregate bar's denominator.
+func ParseSize(size string) int64 {
+	size = strings.TrimSpace(size)
+	if size == "" {
+		return 0
+	}
+
+	parts := strings.Fields(size)
+	if len(parts) != 2 {
+		return 0
+	}
+
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0
+	}
+
+	multiplier, ok := sizeUnits[strings.ToUpper(parts[1])]
+	if !ok {
+		return 0
+	}
+
+	return int64(value * float64(multiplier))
+}
@@ -0,0 +1,250 @@
+// Package selfupdate polls GitHub for a newer release of gog-backup and, when asked to, replaces the
+// running binary with it - similar in spirit to an overseer-style fetcher, but without overseer's
+// separate master/slave process pair, since a single backup run doesn't need zero-downtime restarts.
+package selfupdate
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// releasesURL is the GitHub API endpoint for this project's latest release.
+const releasesURL = "https://api.github.com/repos/mscharley/gog-backup/releases/latest"
+
+var (
+	checkInterval = flag.Duration("update-check-interval", 24*time.Hour, "How often to check GitHub for a new release.")
+	autoUpdate    = flag.Bool("auto-update", false, "Automatically download, verify and apply an update when one is found, restarting the process. (default: just log that one is available)")
+)
+
+// release mirrors the fields gog-backup needs from GitHub's "get the latest release" API response.
+type release struct {
+	TagName string  `json:"tag_name"`
+	Assets  []asset `json:"assets"`
+}
+
+type asset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+}
+
+// Run checks GitHub for a latest release whose tag differs from version every
+// -update-check-interval, until finished is closed. A release matching this platform is logged when
+// found; with -auto-update it's downloaded, verified and swapped in, and the process re-execs itself
+// with its original args. Run is started as its own goroutine alongside the download pipeline and
+// never touches the download channels. With -auto-update, the re-exec happens as soon as the update
+// is applied and doesn't wait for downloads in progress, which end with the old process.
+func Run(finished <-chan bool, version string) {
+	ticker := time.NewTicker(*checkInterval)
+	defer ticker.Stop()
+
+	for {
+		check(version)
+
+		select {
+		case <-ticker.C:
+			// Loop around and check again.
+		case <-finished:
+			return
+		}
+	}
+}
+
+func check(version string) {
+	rel, err := fetchLatestRelease()
+	if err != nil {
+		log.Printf("Unable to check for updates: %+v", err)
+		return
+	}
+	if rel.TagName == version {
+		return
+	}
+
+	bin, checksum, ok := findAssets(rel.Assets)
+	if !ok {
+		log.Printf("Update %s is available, but no matching release asset was found for %s/%s.", rel.TagName, runtime.GOOS, runtime.GOARCH)
+		return
+	}
+
+	if !*autoUpdate {
+		log.Printf("Update %s is available. Restart with -auto-update to apply it automatically.", rel.TagName)
+		return
+	}
+
+	if err := apply(bin, checksum); err != nil {
+		log.Printf("Unable to apply update %s: %+v", rel.TagName, err)
+		return
+	}
+
+	log.Printf("Updated to %s, restarting.", rel.TagName)
+	if err := syscall.Exec(os.Args[0], os.Args, os.Environ()); err != nil {
+		log.Fatalf("Unable to restart after updating: %+v", err)
+	}
+}
+
+func fetchLatestRelease() (*release, error) {
+	resp, err := http.Get(releasesURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d fetching latest release", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	rel := &release{}
+	if err := json.Unmarshal(body, rel); err != nil {
+		return nil, err
+	}
+
+	return rel, nil
+}
+
+// findAssets locates the release asset for the current platform - one whose name contains both
+// runtime.GOOS and runtime.GOARCH - along with its ".sha256" checksum sidecar asset. ok is false if
+// either is missing, which leaves check to just log that a release exists without a usable asset.
+func findAssets(assets []asset) (bin *asset, checksum *asset, ok bool) {
+	for i, a := range assets {
+		if strings.HasSuffix(a.Name, ".sha256") {
+			continue
+		}
+		if strings.Contains(a.Name, runtime.GOOS) && strings.Contains(a.Name, runtime.GOARCH) {
+			bin = &assets[i]
+			break
+		}
+	}
+	if bin == nil {
+		return nil, nil, false
+	}
+
+	for i, a := range assets {
+		if a.Name == bin.Name+".sha256" {
+			checksum = &assets[i]
+			break
+		}
+	}
+	if checksum == nil {
+		return nil, nil, false
+	}
+
+	return bin, checksum, true
+}
+
+// apply downloads bin (transparently decompressing it if it was served gzip-encoded), verifies it
+// against the SHA-256 published in checksum, and atomically replaces the running executable with it.
+func apply(bin *asset, checksum *asset) error {
+	expected, err := fetchChecksum(checksum.BrowserDownloadURL)
+	if err != nil {
+		return fmt.Errorf("unable to fetch checksum: %+v", err)
+	}
+
+	tmpPath, sum, err := downloadToTemp(bin.BrowserDownloadURL)
+	if err != nil {
+		return fmt.Errorf("unable to download update: %+v", err)
+	}
+	if sum != expected {
+		os.Remove(tmpPath)
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, sum)
+	}
+
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, exe)
+}
+
+func fetchChecksum(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d fetching checksum", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// The .sha256 sidecar is conventionally "<sum>  <filename>\n" - only the first field matters.
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file")
+	}
+
+	return fields[0], nil
+}
+
+// downloadToTemp streams url into a temp file next to the running executable (so apply's rename
+// stays on one filesystem), transparently gunzipping the body when it was served gzip-encoded, and
+// returns the temp file's path along with its SHA-256 hash.
+func downloadToTemp(url string) (string, string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("unexpected status code %d downloading update", resp.StatusCode)
+	}
+
+	var reader io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" || strings.HasSuffix(url, ".gz") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return "", "", err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), ".gog-backup-update-")
+	if err != nil {
+		return "", "", err
+	}
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(tmp, io.TeeReader(reader, hasher)); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+
+	return tmp.Name(), hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,132 @@
+package gog
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// EmbedEndpoint is the base URL for GoG's embed API, used to resolve download and metadata links.
+const EmbedEndpoint = "https://embed.gog.com"
+
+// GameMediaType is the media type filter for regular games, as opposed to movies.
+const GameMediaType = 1
+
+// Client is a thin wrapper around GoG's embed API, authenticated via an OAuth refresh token.
+type Client struct {
+	Client       *http.Client
+	RefreshToken string
+}
+
+// FilteredProducts is the response from the account/getFilteredProducts endpoint.
+type FilteredProducts struct {
+	TotalPages int `json:"totalPages"`
+	Products   []struct {
+		ID int64 `json:"id"`
+	} `json:"products"`
+}
+
+// PlatformFile describes a single downloadable installer for one platform.
+type PlatformFile struct {
+	Name              string `json:"name"`
+	Size              string `json:"size"`
+	Version           string `json:"version"`
+	ManualDownloadURL string `json:"manualUrl"`
+}
+
+// Platforms groups the per-OS installers for a single download entry.
+type Platforms struct {
+	Windows []PlatformFile `json:"windows"`
+	Mac     []PlatformFile `json:"mac"`
+	Linux   []PlatformFile `json:"linux"`
+}
+
+// Download is a single version/language grouping of installers.
+type Download struct {
+	Platforms Platforms `json:"platform"`
+}
+
+// Extra is a non-installer bonus file, such as a soundtrack or manual.
+type Extra struct {
+	Name              string `json:"name"`
+	Size              string `json:"size"`
+	Version           string `json:"version"`
+	ManualDownloadURL string `json:"manualUrl"`
+}
+
+// GameDetails is the response from the account/gameDetails endpoint.
+type GameDetails struct {
+	Title     string         `json:"title"`
+	Downloads []Download     `json:"downloads"`
+	Extras    []Extra        `json:"extras"`
+	DLCs      []*GameDetails `json:"dlcs"`
+}
+
+// GetFilteredProducts fetches a page of the user's library, filtered to the given media type.
+func (c *Client) GetFilteredProducts(mediaType int, page int) (*FilteredProducts, error) {
+	req, err := c.newRequest("GET", fmt.Sprintf("%s/account/getFilteredProducts?mediaType=%d&page=%d", EmbedEndpoint, mediaType, page))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &FilteredProducts{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GameDetails fetches the full download metadata for a single product ID.
+func (c *Client) GameDetails(id int64) (*GameDetails, error) {
+	req, err := c.newRequest("GET", fmt.Sprintf("%s/account/gameDetails/%d.json", EmbedEndpoint, id))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &GameDetails{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (c *Client) newRequest(method string, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.RefreshToken)
+
+	return req, nil
+}
+
+// filenameFromResponse extracts the server-suggested filename from a Content-Disposition header,
+// falling back to the last path segment of the URL.
+func filenameFromResponse(resp *http.Response) string {
+	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
+		if _, params, err := mime.ParseMediaType(cd); err == nil {
+			if filename, ok := params["filename"]; ok {
+				return filename
+			}
+		}
+	}
+
+	parts := strings.Split(resp.Request.URL.Path, "/")
+	return parts[len(parts)-1]
+}
@@ -0,0 +1,112 @@
+package gog
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// DownloadFile opens a streaming download of url and returns the filename GoG reports via the
+// Content-Disposition header along with a reader for its contents.
+func (c *Client) DownloadFile(url string) (string, io.ReadCloser, error) {
+	req, err := c.newRequest("GET", url)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return "", nil, fmt.Errorf("unexpected status code %d downloading %s", resp.StatusCode, url)
+	}
+
+	return filenameFromResponse(resp), resp.Body, nil
+}
+
+// DownloadFileRange resumes a streaming download of url starting at offset, using an HTTP Range
+// request. GoG's download endpoints support byte ranges, so this can be used to continue an
+// interrupted download without re-fetching bytes that were already written to disk.
+func (c *Client) DownloadFileRange(url string, offset int64) (string, io.ReadCloser, error) {
+	req, err := c.newRequest("GET", url)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return "", nil, fmt.Errorf("server does not support resuming (status %d) for %s", resp.StatusCode, url)
+	}
+
+	return filenameFromResponse(resp), resp.Body, nil
+}
+
+// checksumXML mirrors the XML document GoG exposes at "<download url>.xml", giving an MD5 sum for
+// the file the download URL points at.
+type checksumXML struct {
+	MD5 string `xml:"md5,attr"`
+}
+
+// FileChecksum fetches and parses the MD5 checksum GoG publishes alongside a download at
+// "<url>.xml". An empty string is returned if GoG doesn't publish a checksum for this file.
+func (c *Client) FileChecksum(url string) (string, error) {
+	req, err := c.newRequest("GET", url+".xml")
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	info := &checksumXML{}
+	if err := xml.Unmarshal(body, info); err != nil {
+		return "", err
+	}
+
+	return info.MD5, nil
+}
+
+// VerifyChecksum hashes the file at path with MD5 and compares it against the expected checksum.
+// An empty expected checksum always verifies, since not every GoG download publishes one.
+func VerifyChecksum(path string, expected string) (bool, error) {
+	if expected == "" {
+		return true, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return false, err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)) == expected, nil
+}